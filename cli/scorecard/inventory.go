@@ -15,15 +15,27 @@
 package scorecard
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/briandowns/spinner"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 
 	asset "cloud.google.com/go/asset/apiv1"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/iterator"
 	assetpb "google.golang.org/genproto/googleapis/cloud/asset/v1"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // inventoryConfig manages a CAI inventory
@@ -32,6 +44,15 @@ type inventoryConfig struct {
 	controlProjectID string
 	organizationID   string
 	gcsBucket        string
+	contentTypes     []assetpb.ContentType
+	bqProject        string
+	bqDataset        string
+	bqTablePrefix    string
+	maxAge           time.Duration
+	force            bool
+	ensureBucket     bool
+	bucketLocation   string
+	bucketTTLDays    int64
 }
 
 // Option for NewInventory
@@ -51,11 +72,69 @@ func TargetProject(projectID string) Option {
 	}
 }
 
+// WithContentTypes overrides the set of Cloud Asset content types that are
+// exported. If not supplied, NewInventory defaults to RESOURCE and
+// IAM_POLICY.
+func WithContentTypes(contentTypes ...assetpb.ContentType) Option {
+	return func(inventory *inventoryConfig) {
+		inventory.contentTypes = contentTypes
+	}
+}
+
+// BigQueryDataset directs inventory exports to a BigQuery dataset instead of
+// the GCS bucket. Each content type is written to its own table, named
+// tablePrefix plus the lower-cased content type (e.g. "inventory_resource").
+func BigQueryDataset(project, dataset, tablePrefix string) Option {
+	return func(inventory *inventoryConfig) {
+		inventory.bqProject = project
+		inventory.bqDataset = dataset
+		inventory.bqTablePrefix = tablePrefix
+	}
+}
+
+// MaxAge skips re-exporting a content type whose GCS destination object was
+// updated more recently than maxAge ago, reusing the cached inventory
+// instead. Has no effect on a BigQuery destination, or when Force is set.
+func MaxAge(maxAge time.Duration) Option {
+	return func(inventory *inventoryConfig) {
+		inventory.maxAge = maxAge
+	}
+}
+
+// Force always exports, bypassing the MaxAge freshness cache.
+func Force() Option {
+	return func(inventory *inventoryConfig) {
+		inventory.force = true
+	}
+}
+
+// EnsureBucket creates the GCS destination bucket in location if it does
+// not already exist, grants the Cloud Asset service agent write access to
+// it, and installs a lifecycle rule that deletes objects older than
+// ttlDays. A bucket that already exists is left unchanged: the grant and
+// the lifecycle rule are applied only to a bucket that EnsureBucket
+// creates. Has no effect when the inventory is configured with
+// BigQueryDataset.
+func EnsureBucket(location string, ttlDays int64) Option {
+	return func(inventory *inventoryConfig) {
+		inventory.ensureBucket = true
+		inventory.bucketLocation = location
+		inventory.bucketTTLDays = ttlDays
+	}
+}
+
+// defaultContentTypes is used when NewInventory is not given WithContentTypes.
+var defaultContentTypes = []assetpb.ContentType{
+	assetpb.ContentType_RESOURCE,
+	assetpb.ContentType_IAM_POLICY,
+}
+
 // NewInventory creates a new CAI inventory manager
 func NewInventory(projectID string, bucketName string, options ...Option) (*inventoryConfig, error) {
 	inventory := new(inventoryConfig)
 	inventory.controlProjectID = projectID
 	inventory.gcsBucket = bucketName
+	inventory.contentTypes = defaultContentTypes
 
 	for _, option := range options {
 		option(inventory)
@@ -73,8 +152,12 @@ func getParent(inventory *inventoryConfig) string {
 }
 
 var destinationObjectNames = map[assetpb.ContentType]string{
-	assetpb.ContentType_RESOURCE:   "resource_inventory.json",
-	assetpb.ContentType_IAM_POLICY: "iam_inventory.json",
+	assetpb.ContentType_RESOURCE:      "resource_inventory.json",
+	assetpb.ContentType_IAM_POLICY:    "iam_inventory.json",
+	assetpb.ContentType_ORG_POLICY:    "org_policy_inventory.json",
+	assetpb.ContentType_ACCESS_POLICY: "access_policy_inventory.json",
+	assetpb.ContentType_OS_INVENTORY:  "os_inventory.json",
+	assetpb.ContentType_RELATIONSHIP:  "relationship_inventory.json",
 }
 
 func (inventory inventoryConfig) getGcsDestination(contentType assetpb.ContentType) *assetpb.GcsDestination_Uri {
@@ -84,24 +167,58 @@ func (inventory inventoryConfig) getGcsDestination(contentType assetpb.ContentTy
 	}
 }
 
-func exportInventoryToGcs(inventory *inventoryConfig, contentType assetpb.ContentType) error {
-	ctx := context.Background()
+// bigQueryTableName returns the destination table for contentType, e.g.
+// "inventory_resource" for a tablePrefix of "inventory".
+func bigQueryTableName(tablePrefix string, contentType assetpb.ContentType) string {
+	return fmt.Sprintf("%v_%v", tablePrefix, strings.ToLower(contentType.String()))
+}
+
+func (inventory inventoryConfig) getBigQueryDestination(contentType assetpb.ContentType) *assetpb.BigQueryDestination {
+	return &assetpb.BigQueryDestination{
+		Dataset: fmt.Sprintf("projects/%v/datasets/%v", inventory.bqProject, inventory.bqDataset),
+		Table:   bigQueryTableName(inventory.bqTablePrefix, contentType),
+		Force:   true,
+		PartitionSpec: &assetpb.PartitionSpec{
+			PartitionKey: assetpb.PartitionSpec_READ_TIME,
+		},
+	}
+}
+
+// usesBigQuery reports whether this inventory was configured with
+// BigQueryDataset, in which case exports go to BigQuery instead of GCS.
+func (inventory inventoryConfig) usesBigQuery() bool {
+	return inventory.bqDataset != ""
+}
+
+func exportInventory(ctx context.Context, inventory *inventoryConfig, contentType assetpb.ContentType) error {
 	c, err := asset.NewClient(ctx)
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 
-	destination := inventory.getGcsDestination(contentType)
-	req := &assetpb.ExportAssetsRequest{
-		Parent:      getParent(inventory),
-		ContentType: contentType,
-		OutputConfig: &assetpb.OutputConfig{
-			Destination: &assetpb.OutputConfig_GcsDestination{
-				GcsDestination: &assetpb.GcsDestination{
-					ObjectUri: destination,
-				},
+	outputConfig := &assetpb.OutputConfig{}
+	var destination interface{}
+	if inventory.usesBigQuery() {
+		bqDestination := inventory.getBigQueryDestination(contentType)
+		outputConfig.Destination = &assetpb.OutputConfig_BigQueryDestination{
+			BigQueryDestination: bqDestination,
+		}
+		destination = bqDestination
+	} else {
+		gcsDestination := inventory.getGcsDestination(contentType)
+		outputConfig.Destination = &assetpb.OutputConfig_GcsDestination{
+			GcsDestination: &assetpb.GcsDestination{
+				ObjectUri: gcsDestination,
 			},
-		},
+		}
+		destination = gcsDestination
+	}
+
+	req := &assetpb.ExportAssetsRequest{
+		Parent:       getParent(inventory),
+		ContentType:  contentType,
+		OutputConfig: outputConfig,
 	}
 
 	op, err := c.ExportAssets(ctx, req)
@@ -113,18 +230,338 @@ func exportInventoryToGcs(inventory *inventoryConfig, contentType assetpb.Conten
 	return err
 }
 
-// ExportInventory creates a new inventory export
-func ExportInventory(inventory *inventoryConfig) error {
+// isFresh reports whether inventory's GCS destination object for contentType
+// was updated more recently than inventory.maxAge ago.
+func isFresh(ctx context.Context, inventory *inventoryConfig, contentType assetpb.ContentType) (bool, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	objectName := destinationObjectNames[contentType]
+	attrs, err := client.Bucket(inventory.gcsBucket).Object(objectName).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return attrs.Updated.After(time.Now().Add(-inventory.maxAge)), nil
+}
+
+// staleContentTypes returns the subset of inventory.contentTypes that need a
+// fresh export, skipping (and logging) any whose cached GCS object is
+// already within inventory.maxAge.
+func staleContentTypes(ctx context.Context, inventory *inventoryConfig) ([]assetpb.ContentType, error) {
+	if inventory.force || inventory.maxAge <= 0 || inventory.usesBigQuery() {
+		return inventory.contentTypes, nil
+	}
+
+	var stale []assetpb.ContentType
+	for _, contentType := range inventory.contentTypes {
+		fresh, err := isFresh(ctx, inventory, contentType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "checking freshness of %v", contentType)
+		}
+		if fresh {
+			Log.Debug("Reusing cached inventory", "contentType", contentType, "maxAge", inventory.maxAge)
+			continue
+		}
+		stale = append(stale, contentType)
+	}
+	return stale, nil
+}
+
+// cloudAssetServiceAccount returns the Cloud Asset service agent for
+// projectID, which must be granted write access to the destination bucket
+// before ExportAssets can write to it.
+func cloudAssetServiceAccount(ctx context.Context, projectID string) (string, error) {
+	crm, err := cloudresourcemanager.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	project, err := crm.Projects.Get(projectID).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("service-%v@gcp-sa-cloudasset.iam.gserviceaccount.com", project.ProjectNumber), nil
+}
+
+// ensureBucketExists creates inventory's GCS destination bucket if it is
+// missing, with a lifecycle rule deleting objects older than bucketTTLDays,
+// and grants the Cloud Asset service agent write access to it. If the
+// bucket already exists it returns without changing its lifecycle or IAM
+// policy. It is a no-op unless EnsureBucket was passed to NewInventory,
+// and for a BigQuery destination.
+func ensureBucketExists(ctx context.Context, inventory *inventoryConfig) error {
+	if !inventory.ensureBucket || inventory.usesBigQuery() {
+		return nil
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(inventory.gcsBucket)
+	if _, err := bucket.Attrs(ctx); err != storage.ErrBucketNotExist {
+		if err != nil {
+			return errors.Wrap(err, "checking inventory bucket")
+		}
+		return nil
+	}
+
+	if err := bucket.Create(ctx, inventory.controlProjectID, &storage.BucketAttrs{
+		Location:                 inventory.bucketLocation,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: true},
+		Lifecycle: storage.Lifecycle{
+			Rules: []storage.LifecycleRule{
+				{
+					Action:    storage.LifecycleAction{Type: "Delete"},
+					Condition: storage.LifecycleCondition{AgeInDays: inventory.bucketTTLDays},
+				},
+			},
+		},
+	}); err != nil {
+		return errors.Wrap(err, "creating inventory bucket; grant roles/storage.admin on the control project and retry")
+	}
+
+	serviceAccount, err := cloudAssetServiceAccount(ctx, inventory.controlProjectID)
+	if err != nil {
+		return errors.Wrap(err, "looking up the Cloud Asset service agent")
+	}
+
+	policy, err := bucket.IAM().Policy(ctx)
+	if err != nil {
+		return errors.Wrap(err, "reading inventory bucket IAM policy")
+	}
+	policy.Add(fmt.Sprintf("serviceAccount:%v", serviceAccount), iam.RoleName("roles/storage.objectAdmin"))
+	if err := bucket.IAM().SetPolicy(ctx, policy); err != nil {
+		return errors.Wrap(err, "granting the Cloud Asset service agent write access; grant roles/storage.objectAdmin manually and retry")
+	}
+
+	return nil
+}
+
+// ExportInventory creates a new inventory export, fanning the content types
+// out concurrently. ctx is plumbed into every Asset client call, so callers
+// can cancel the export or bound it with a deadline. Content types with a
+// destination object fresher than MaxAge are skipped unless Force is set.
+func ExportInventory(ctx context.Context, inventory *inventoryConfig) error {
+	if err := ensureBucketExists(ctx, inventory); err != nil {
+		return err
+	}
+
+	contentTypes, err := staleContentTypes(ctx, inventory)
+	if err != nil {
+		return err
+	}
+	if len(contentTypes) == 0 {
+		Log.Debug("All requested content types have a fresh cached inventory, skipping export")
+		return nil
+	}
+
 	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
-	s.Prefix = "Exporting Cloud Asset Inventory to GCS bucket... "
 	s.Start()
-	err := exportInventoryToGcs(inventory, assetpb.ContentType_RESOURCE)
-	err = exportInventoryToGcs(inventory, assetpb.ContentType_IAM_POLICY)
+
+	var inFlightMu sync.Mutex
+	inFlight := make(map[assetpb.ContentType]bool, len(contentTypes))
+	updatePrefix := func() {
+		inFlightMu.Lock()
+		defer inFlightMu.Unlock()
+		names := make([]string, 0, len(inFlight))
+		for contentType := range inFlight {
+			names = append(names, contentType.String())
+		}
+		s.Prefix = fmt.Sprintf("Exporting Cloud Asset Inventory (%v)... ", strings.Join(names, ", "))
+	}
+
+	var resultMu sync.Mutex
+	var result *multierror.Error
+
+	var wg sync.WaitGroup
+	for _, contentType := range contentTypes {
+		contentType := contentType
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			inFlightMu.Lock()
+			inFlight[contentType] = true
+			inFlightMu.Unlock()
+			updatePrefix()
+
+			defer func() {
+				inFlightMu.Lock()
+				delete(inFlight, contentType)
+				inFlightMu.Unlock()
+				updatePrefix()
+			}()
+
+			// A failing RESOURCE export must not stop an in-flight
+			// IAM_POLICY export, so every goroutine reports its own error
+			// into result instead of cancelling its siblings.
+			if err := exportInventory(ctx, inventory, contentType); err != nil {
+				resultMu.Lock()
+				result = multierror.Append(result, errors.Wrapf(err, "exporting %v", contentType))
+				resultMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
 	s.Stop()
 
+	return result.ErrorOrNil()
+}
+
+// InventoryReader gives scorecard rule evaluation newline-delimited JSON
+// asset records for a content type, regardless of whether they were
+// exported to GCS ahead of time or are streamed live from the Asset API.
+type InventoryReader interface {
+	Open(ctx context.Context, contentType assetpb.ContentType) (io.ReadCloser, error)
+}
+
+type gcsInventoryReader struct {
+	inventory *inventoryConfig
+}
+
+// NewGCSInventoryReader returns an InventoryReader that reads an inventory's
+// previously exported content type files from GCS.
+func NewGCSInventoryReader(inventory *inventoryConfig) InventoryReader {
+	return gcsInventoryReader{inventory: inventory}
+}
+
+// clientClosingReader closes client after delegating Close to the reader it
+// wraps, so opening a GCS object doesn't leak the storage.Client that
+// created it.
+type clientClosingReader struct {
+	io.Reader
+	reader io.Closer
+	client io.Closer
+}
+
+func (r clientClosingReader) Close() error {
+	err := r.reader.Close()
+	if clientErr := r.client.Close(); clientErr != nil && err == nil {
+		err = clientErr
+	}
+	return err
+}
+
+func (r gcsInventoryReader) Open(ctx context.Context, contentType assetpb.ContentType) (io.ReadCloser, error) {
+	client, err := storage.NewClient(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	objectName := destinationObjectNames[contentType]
+	reader, err := client.Bucket(r.inventory.gcsBucket).Object(objectName).NewReader(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return clientClosingReader{Reader: reader, reader: reader, client: client}, nil
+}
+
+// bigQueryInventoryReader reads an inventory's previously exported content
+// type tables back out of BigQuery, one newline-delimited JSON record per
+// row, so it satisfies the same InventoryReader contract as the GCS and
+// streaming sources.
+type bigQueryInventoryReader struct {
+	inventory *inventoryConfig
+}
+
+func (r bigQueryInventoryReader) Open(ctx context.Context, contentType assetpb.ContentType) (io.ReadCloser, error) {
+	client, err := bigquery.NewClient(ctx, r.inventory.bqProject)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	table := bigQueryTableName(r.inventory.bqTablePrefix, contentType)
+	query := client.Query(fmt.Sprintf("SELECT * FROM `%v.%v.%v`", r.inventory.bqProject, r.inventory.bqDataset, table))
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for {
+		var row map[string]bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+
+	return io.NopCloser(&buf), nil
+}
+
+// Reader returns the InventoryReader that scorecard rules should pull this
+// inventory's exported content from, picking BigQuery or GCS based on how
+// the inventory was configured.
+func (inventory *inventoryConfig) Reader() InventoryReader {
+	if inventory.usesBigQuery() {
+		return bigQueryInventoryReader{inventory: inventory}
+	}
+	return NewGCSInventoryReader(inventory)
+}
+
+// streamingInventory lists assets live via the Asset API's ListAssets call
+// and buffers them in memory, bypassing the GCS export round trip
+// entirely. It suits small projects or folders where standing up an export
+// bucket is more overhead than the export saves.
+type streamingInventory struct {
+	parent string
+}
+
+// NewStreamingInventory creates an InventoryReader that pages through
+// parent's assets with ListAssets instead of requiring a prior GCS export.
+func NewStreamingInventory(parent string) InventoryReader {
+	return streamingInventory{parent: parent}
+}
+
+func (s streamingInventory) Open(ctx context.Context, contentType assetpb.ContentType) (io.ReadCloser, error) {
+	c, err := asset.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var buf bytes.Buffer
+	it := c.ListAssets(ctx, &assetpb.ListAssetsRequest{
+		Parent:      s.parent,
+		ContentType: contentType,
+	})
+	for {
+		a, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// protojson, not encoding/json, so this matches the shape the GCS
+		// exporter produces for the same content type (structpb.Struct and
+		// timestamppb.Timestamp fields need protobuf-aware marshaling).
+		b, err := protojson.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	return io.NopCloser(&buf), nil
 }